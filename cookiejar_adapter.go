@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// persistentJar wraps a cookiejar.Jar so it can be snapshotted to, and
+// restored from, a plain map[string][]*http.Cookie - cookiejar.Jar itself
+// keeps no public record of which URLs it holds cookies for, so we have to
+// track that ourselves as SetCookies is called.
+type persistentJar struct {
+	lock *sync.Mutex
+	jar  *cookiejar.Jar
+	urls map[string]*url.URL
+}
+
+func newPersistentJar() *persistentJar {
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return &persistentJar{lock: &sync.Mutex{}, jar: jar, urls: make(map[string]*url.URL)}
+}
+
+func (j *persistentJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.lock.Lock()
+	j.urls[u.String()] = u
+	j.lock.Unlock()
+	j.jar.SetCookies(u, cookies)
+}
+
+func (j *persistentJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// Snapshot dumps every cookie the jar is holding, keyed by the URL it was
+// set against, so it can be gob-encoded or stored in redis.
+func (j *persistentJar) Snapshot() map[string][]*http.Cookie {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	snapshot := make(map[string][]*http.Cookie, len(j.urls))
+	for raw, u := range j.urls {
+		if cookies := j.jar.Cookies(u); len(cookies) > 0 {
+			snapshot[raw] = cookies
+		}
+	}
+	return snapshot
+}
+
+// restoreJar rebuilds a persistentJar from a Snapshot taken earlier,
+// typically after loading it back from disk or redis on Start.
+func restoreJar(snapshot map[string][]*http.Cookie) *persistentJar {
+	j := newPersistentJar()
+	for raw, cookies := range snapshot {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		j.SetCookies(u, cookies)
+	}
+	return j
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodeBody transparently decompresses resp.Body according to its
+// Content-Encoding header, so the HTML/CSS rewriters always see plain text
+// regardless of what the upstream server sent.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		return flate.NewReader(resp.Body), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(resp.Body)), nil
+	default:
+		return resp.Body, nil
+	}
+}
+
+// negotiateEncoding walks the encodings Gopee knows how to re-encode with,
+// in its own order of preference (gzip, br, deflate), and picks the first
+// one named anywhere in the client's Accept-Encoding header; the header's
+// order and q-values are not considered. An empty result means the
+// rewritten body should be sent uncompressed.
+func negotiateEncoding(acceptEncoding string) string {
+	for _, encoding := range []string{"gzip", "br", "deflate"} {
+		if strings.Contains(acceptEncoding, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// wrapEncoder wraps w with a compressor matching encoding, so the rewritten
+// body is re-encoded the way the client asked for. Close must be called to
+// flush any buffered output.
+func wrapEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return flate.NewWriter(w, flate.DefaultCompression)
+	case "br":
+		return brotli.NewWriter(w), nil
+	case "":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, errors.New("encoding: unsupported encoding " + encoding)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
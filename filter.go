@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errMaxSizeExceeded is surfaced to the io.Copy driving the response body
+// once a limitedBody has delivered its cap, truncating the stream.
+var errMaxSizeExceeded = errors.New("filter: response exceeds the maximum allowed size")
+
+// Filter lets operators enforce policy on proxied traffic - a max response
+// size, a MIME or host allow/deny list, a tracker-domain scrubber - without
+// touching Fetch itself, the same way AdGuardHome layers adblock rules.
+type Filter interface {
+	// Request is run once the outbound request to the target has been
+	// built, before it's sent.
+	Request(*http.Request) error
+	// Response is run once the upstream response comes back, before its
+	// body is rewritten or copied to the client.
+	Response(*http.Response) error
+}
+
+var filters []Filter
+
+// RegisterFilter adds f to the chain Fetch consults for every request.
+func RegisterFilter(f Filter) {
+	filters = append(filters, f)
+}
+
+// filterError is returned by a Filter to reject a request/response with a
+// specific HTTP status, instead of the 502 writeFilterError uses for any
+// other error.
+type filterError struct {
+	status  int
+	message string
+}
+
+func (e *filterError) Error() string { return e.message }
+
+func runRequestFilters(req *http.Request) error {
+	for _, f := range filters {
+		if err := f.Request(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runResponseFilters(resp *http.Response) error {
+	for _, f := range filters {
+		if err := f.Response(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFilterError renders a Filter's rejection with its requested status,
+// falling back to 502 for anything Fetch doesn't otherwise turn into a
+// filterError.
+func writeFilterError(w http.ResponseWriter, err error) {
+	if ferr, ok := err.(*filterError); ok {
+		http.Error(w, ferr.message, ferr.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// MaxSizeFilter rejects responses that declare a Content-Length over
+// MaxBytes, and truncates responses that grow past it when the length
+// wasn't known upfront (chunked transfer encoding).
+type MaxSizeFilter struct {
+	MaxBytes int64
+}
+
+func (f *MaxSizeFilter) Request(*http.Request) error { return nil }
+
+func (f *MaxSizeFilter) Response(resp *http.Response) error {
+	if f.MaxBytes <= 0 {
+		return nil
+	}
+	if resp.ContentLength > f.MaxBytes {
+		return &filterError{http.StatusRequestEntityTooLarge, "response exceeds the maximum allowed size"}
+	}
+	resp.Body = &limitedBody{body: resp.Body, remaining: f.MaxBytes}
+	return nil
+}
+
+// limitedBody silently truncates a response body once it has delivered
+// MaxBytes - there's no way to turn a streaming response already underway
+// into a clean 413 page, so this is the best a proxy can do once the
+// upstream's Content-Length wasn't known in advance.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, errMaxSizeExceeded
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// MIMEFilter enforces an allow/deny list against the response's
+// Content-Type, e.g. to block application/octet-stream downloads while
+// still allowing text/html and images through.
+type MIMEFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+func (f *MIMEFilter) Request(*http.Request) error { return nil }
+
+func (f *MIMEFilter) Response(resp *http.Response) error {
+	contentType := resp.Header.Get("Content-Type")
+	for _, deny := range f.Deny {
+		if strings.Contains(contentType, deny) {
+			return &filterError{http.StatusForbidden, "content type not allowed: " + contentType}
+		}
+	}
+	if len(f.Allow) == 0 {
+		return nil
+	}
+	for _, allow := range f.Allow {
+		if strings.Contains(contentType, allow) {
+			return nil
+		}
+	}
+	return &filterError{http.StatusForbidden, "content type not allowed: " + contentType}
+}
+
+// HostFilter enforces an allow/deny list against the target host, with
+// "*.example.com" wildcards and CIDR ranges supported, and refuses to
+// proxy to a private, loopback or link-local address unless AllowPrivate
+// is set - the baseline SSRF guard for a proxy that takes arbitrary
+// target URLs from its callers.
+type HostFilter struct {
+	Allow        []string
+	Deny         []string
+	AllowPrivate bool
+}
+
+func (f *HostFilter) Request(req *http.Request) error {
+	host := req.URL.Hostname()
+
+	for _, deny := range f.Deny {
+		if matchHostPattern(deny, host) {
+			return &filterError{http.StatusForbidden, "host is denied: " + host}
+		}
+	}
+	if len(f.Allow) > 0 {
+		allowed := false
+		for _, allow := range f.Allow {
+			if matchHostPattern(allow, host) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &filterError{http.StatusForbidden, "host is not allow-listed: " + host}
+		}
+	}
+	if !f.AllowPrivate {
+		return rejectPrivateHost(host)
+	}
+	return nil
+}
+
+func (f *HostFilter) Response(*http.Response) error { return nil }
+
+// matchHostOrIPPattern is the one rule Allow/Deny patterns are checked
+// against - a "*.example.com" wildcard or exact name matches against host,
+// a CIDR matches against ip - whether called before a DNS lookup
+// (matchHostPattern, resolving ip itself) or after the dial's own lookup
+// has already happened and been pinned (checkResolvedHost, with ip already
+// in hand).
+func matchHostOrIPPattern(pattern, host string, ip net.IP) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.EqualFold(host, pattern[2:]) || strings.HasSuffix(strings.ToLower(host), strings.ToLower(pattern[1:]))
+	}
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		return ip != nil && network.Contains(ip)
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+func matchHostPattern(pattern, host string) bool {
+	if _, _, err := net.ParseCIDR(pattern); err == nil {
+		for _, ip := range resolveHost(host) {
+			if matchHostOrIPPattern(pattern, host, ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return matchHostOrIPPattern(pattern, host, nil)
+}
+
+// resolveHost returns host's address(es): itself if it's already an IP
+// literal, or its resolved addresses if it's a DNS name. It returns nil,
+// rather than erroring, if host can't be resolved here - callers that need
+// to fail closed on an unresolvable host (safeDialContext) check for that
+// themselves; rejectPrivateHost lets an unresolvable host through.
+func resolveHost(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	return ips
+}
+
+// rejectPrivateHost resolves host and rejects it if any of its addresses
+// are private, loopback or link-local.
+func rejectPrivateHost(host string) error {
+	for _, ip := range resolveHost(host) {
+		if isPrivateIP(ip) {
+			return &filterError{http.StatusForbidden, "refusing to proxy to a private address: " + ip.String()}
+		}
+	}
+	return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// checkResolvedHost re-applies every registered HostFilter's allow/deny/
+// private-address rules to a single already-resolved ip, instead of
+// re-resolving host itself the way HostFilter.Request does - the dial-time
+// counterpart safeDialContext uses so the address it actually connects to
+// is the one that gets checked.
+func checkResolvedHost(host string, ip net.IP) error {
+	for _, f := range filters {
+		hf, ok := f.(*HostFilter)
+		if !ok {
+			continue
+		}
+		for _, deny := range hf.Deny {
+			if matchHostOrIPPattern(deny, host, ip) {
+				return &filterError{http.StatusForbidden, "host is denied: " + host}
+			}
+		}
+		if len(hf.Allow) > 0 {
+			allowed := false
+			for _, allow := range hf.Allow {
+				if matchHostOrIPPattern(allow, host, ip) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return &filterError{http.StatusForbidden, "host is not allow-listed: " + host}
+			}
+		}
+		if !hf.AllowPrivate && isPrivateIP(ip) {
+			return &filterError{http.StatusForbidden, "refusing to proxy to a private address: " + ip.String()}
+		}
+	}
+	return nil
+}
+
+// safeDialContext resolves addr's host exactly once and dials the literal
+// address it validated, instead of handing the hostname to net.Dialer and
+// letting it resolve a second time. HostFilter.Request checks the same
+// rules moments earlier against a first resolution - without this, a host
+// that answers a public address for that check and a private one when the
+// real connection resolves it again (DNS rebinding, trivial with a TTL=0
+// record) would sail straight through the filter and still reach the
+// private address. Used as the dialer for direct (non-proxied) outbound
+// connections: the default per-session http.Transport (defaultTransport)
+// and the no-proxy path for a proxied WebSocket dial (dialThroughProxy).
+// Connections made through a session's upstream proxy (buildTransport,
+// dialViaHTTPConnect) don't go through it.
+func safeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := resolveHost(host)
+	if len(ips) == 0 {
+		return nil, errors.New("filter: cannot resolve host: " + host)
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	var lastErr error
+	for _, ip := range ips {
+		if err := checkResolvedHost(host, ip); err != nil {
+			lastErr = err
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// defaultTransport is a copy of http.DefaultTransport with its DialContext
+// replaced by safeDialContext - the baseline transport every session's
+// http.Client uses until ApplyOptions swaps in a proxied one.
+func defaultTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = safeDialContext
+	return t
+}
+
+// defaultMaxResponseSize is used when GOPEE_MAX_RESPONSE_SIZE isn't set.
+const defaultMaxResponseSize = 50 << 20 // 50MB
+
+// maxResponseSize reads GOPEE_MAX_RESPONSE_SIZE (bytes), falling back to
+// defaultMaxResponseSize if it's unset or not a valid number.
+func maxResponseSize() int64 {
+	raw := os.Getenv("GOPEE_MAX_RESPONSE_SIZE")
+	if raw == "" {
+		return defaultMaxResponseSize
+	}
+	size, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || size <= 0 {
+		return defaultMaxResponseSize
+	}
+	return size
+}
+
+// splitAndTrim splits a comma-separated config value into a clean slice,
+// used for the GOPEE_*_ALLOW/DENY env vars.
+func splitAndTrim(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	parts := strings.Split(raw, ",")
+	out := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
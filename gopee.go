@@ -1,12 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base64"
 	"errors"
+	"flag"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -18,11 +17,6 @@ import (
 // GopeeEncPrefix - encoding prefix used while encoding urls
 const GopeeEncPrefix = "xox"
 
-// Pre-compile RegEx
-var reBase = regexp.MustCompile(`base +href="(.*?)"`)
-var reHTML = regexp.MustCompile(`\saction=["']?(.*?)["'\s]|\shref=["']?(.*?)["'\s]|\ssrc=["']?(.*?)["'\s]`)
-var reCSS = regexp.MustCompile(`url\(["']?(.*?)["']?\)`)
-
 var reBase64 = regexp.MustCompile("^(?:[A-Za-z0-9-_]{4})*(?:[A-Za-z0-9-_]{2}==|[A-Za-z0-9-_]{3}=)?$")
 
 // Hop-by-hop headers
@@ -38,22 +32,36 @@ var hopHeaders = map[string]bool{
 }
 
 // Headers that create problem handling response
-// TODO: support gzip compressed response in future
 var skipHeaders = map[string]bool{
 	"content-security-policy":             true, // sent in response
 	"content-security-policy-report-only": true, // sent in response
-	"accept-encoding":                     true, // sent in request
+	"accept-encoding":                     true, // sent in request, Fetch sets its own
 	"cookie":                              true, // sent in request
 }
 
+// urlRewriteFunc rewrites a single URL found in an HTML attribute, inline
+// CSS or (eventually) inline JS, so future rewriters can share the pipeline.
+type urlRewriteFunc func(string) string
+
 type proxyManager struct {
-	req  *http.Request
-	uri  *url.URL
-	resp *http.Response
+	req        *http.Request
+	uri        *url.URL
+	resp       *http.Response
+	xsrfToken  string
+	rewriteURL urlRewriteFunc
 }
 
 var sessionManager *Manager
 
+// stateChangingMethods require a valid XSRF token echoed back via
+// verifyXSRF before ProxyRequest will forward them.
+var stateChangingMethods = map[string]bool{
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
 func encodeURL(plainURL []byte) string {
 	return GopeeEncPrefix + base64.URLEncoding.EncodeToString(plainURL)
 }
@@ -115,11 +123,34 @@ func ProxyRequest(r *http.Request, w http.ResponseWriter) {
 	if uri == nil {
 		// return a 404
 		http.NotFound(w, r)
-	} else {
-		// try fetching the url
-		proxyMan := &proxyManager{r, uri, nil}
-		proxyMan.Fetch(w)
+		return
+	}
+
+	// SSRF guard: reject hosts that are denied, not allow-listed, or
+	// resolve to a private/loopback/link-local address, before dialing
+	// out to them at all - covers both the WebSocket and plain HTTP paths.
+	if err := runRequestFilters(&http.Request{URL: uri}); err != nil {
+		writeFilterError(w, err)
+		return
+	}
+
+	if isWebSocketUpgrade(r) {
+		if !wsProxyEnabled {
+			http.Error(w, "websocket proxying is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		proxyWebSocket(w, r, uri)
+		return
 	}
+
+	if stateChangingMethods[r.Method] && !verifyXSRF(r) {
+		http.Error(w, "invalid or missing XSRF token", http.StatusForbidden)
+		return
+	}
+
+	// try fetching the url
+	proxyMan := &proxyManager{req: r, uri: uri}
+	proxyMan.Fetch(w)
 }
 
 // Fetch makes the actual request to server and writes data with rewritten URLs to response
@@ -131,21 +162,32 @@ func (pm *proxyManager) Fetch(w http.ResponseWriter) {
 
 	// Get the http client assigned to this session
 	// If a session does not exist or is expired, create a new session
-	httpClient, err := sessionManager.Start(w, pm.req)
+	httpClient, sid, err := sessionManager.Start(w, pm.req)
 
 	if err != nil {
 		http.Error(w, "Unable to start session", http.StatusInternalServerError)
 		return
 	}
+	pm.xsrfToken = xsrfToken(sid)
+	pm.rewriteURL = pm.defaultRewriteURL
+	opts := sessionManager.Options(sid)
 	req, _ := http.NewRequest(pm.req.Method, pm.uri.String(), pm.req.Body)
 	// Forward request headers to server
-	copyHeader(req.Header, pm.req.Header)
+	copyHeader(req.Header, pm.req.Header, opts.DropHeaders...)
+	// decodeBody can transparently undo any of these, unlike the old
+	// pipeline which stripped Accept-Encoding and hoped for identity
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
 
 	// Set http client protocol version
 	req.Proto = "HTTP/1.1"
 	req.ProtoMajor = 1
 	req.ProtoMinor = 1
 
+	if err := runRequestFilters(req); err != nil {
+		writeFilterError(w, err)
+		return
+	}
+
 	pm.resp, err = httpClient.Do(req)
 	if err != nil {
 		log.Println("error fetching", pm.uri.String(), err.Error())
@@ -158,28 +200,57 @@ func (pm *proxyManager) Fetch(w http.ResponseWriter) {
 	// http -> https, non-www -> www, login page
 	if pm.uri.String() != pm.resp.Request.URL.String() {
 		pm.uri = pm.resp.Request.URL
+		// rotate the session id so a redirect following a login can't be
+		// used to fixate a pre-auth session
+		if err := sessionManager.Regenerate(w, pm.req); err != nil {
+			log.Println("SESSION::REGENERATE", err.Error())
+		}
 		http.Redirect(w, pm.req, "/"+encodeURL([]byte(pm.uri.String())), 302)
 		return
 	}
 
+	if err := runResponseFilters(pm.resp); err != nil {
+		writeFilterError(w, err)
+		return
+	}
+
 	contentType := pm.resp.Header.Get("Content-Type")
+	rewritable := strings.Contains(contentType, "text/html") || strings.Contains(contentType, "text/css")
 
 	// Forward response headers to client
 	copyHeader(w.Header(), pm.resp.Header)
 
+	// rewriteHTML/rewriteCSS decode the body and re-encode their own
+	// output below, so the headers describing the upstream encoding must
+	// be fixed up before they're written
+	var encoding string
+	if rewritable {
+		encoding = negotiateEncoding(pm.req.Header.Get("Accept-Encoding"))
+		w.Header().Del("Content-Length")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		} else {
+			w.Header().Del("Content-Encoding")
+		}
+	}
+
 	w.WriteHeader(pm.resp.StatusCode)
 
 	// Rewrite all urls
-	if strings.Contains(contentType, "text/html") {
-		pm.rewriteHTML(w)
-	} else if strings.Contains(contentType, "text/css") {
-		pm.rewriteCSS(w)
-	} else {
+	switch {
+	case strings.Contains(contentType, "text/html"):
+		pm.rewriteHTML(w, encoding)
+	case strings.Contains(contentType, "text/css"):
+		pm.rewriteCSS(w, encoding)
+	default:
 		io.Copy(w, pm.resp.Body)
 	}
 }
 
-func copyHeader(dst, src http.Header) {
+// copyHeader copies src onto dst, then strips hop-by-hop headers, Gopee's
+// own problem headers, and any extra headers the caller's session has
+// asked to drop (see SessionOptions.DropHeaders).
+func copyHeader(dst, src http.Header, dropHeaders ...string) {
 	// Copy Headers from src to dst
 	for k, vv := range src {
 		for _, v := range vv {
@@ -193,81 +264,9 @@ func copyHeader(dst, src http.Header) {
 	for h, _ := range skipHeaders {
 		dst.Del(h)
 	}
-}
-
-func (pm *proxyManager) rewriteHTML(w http.ResponseWriter) {
-	body, _ := ioutil.ReadAll(pm.resp.Body)
-	// if there's a <base href> specified in the document
-	// use that as base to encode all URLs in the page
-	baseHrefMatch := reBase.FindSubmatch(body)
-	if len(baseHrefMatch) > 0 {
-		var err error
-		pm.uri, err = url.Parse(string(baseHrefMatch[1][:]))
-		if err != nil {
-			log.Println("Error Parsing " + string(baseHrefMatch[1][:]))
-		}
-	}
-	encodedBody := reHTML.ReplaceAllFunc(body, func(s []byte) []byte {
-		parts := reHTML.FindSubmatchIndex(s)
-		if parts != nil {
-			// replace src attribute
-			srcIndex := parts[2:4]
-			if srcIndex[0] != -1 {
-				return pm.rewriteURI(s, srcIndex[0], srcIndex[1])
-			}
-
-			// replace href attribute
-			hrefIndex := parts[4:6]
-			if hrefIndex[0] != -1 {
-				return pm.rewriteURI(s, hrefIndex[0], hrefIndex[1])
-			}
-
-			// replace form action attribute
-			actionIndex := parts[6:8]
-			if actionIndex[0] != -1 {
-				return pm.rewriteURI(s, actionIndex[0], actionIndex[1])
-			}
-		}
-		return s
-	})
-	w.Write(encodedBody)
-}
-
-func (pm *proxyManager) rewriteCSS(w http.ResponseWriter) {
-	body, _ := ioutil.ReadAll(pm.resp.Body)
-	encodedBody := reCSS.ReplaceAllFunc(body, func(s []byte) []byte {
-		parts := reCSS.FindSubmatchIndex(s)
-		if parts != nil {
-			// replace url attribute in css
-			pathIndex := parts[2:4]
-			if pathIndex[0] != -1 {
-				return pm.rewriteURI(s, pathIndex[0], pathIndex[1])
-			}
-		}
-		return s
-	})
-	w.Write(encodedBody)
-
-}
-
-func (pm *proxyManager) rewriteURI(src []byte, start int, end int) []byte {
-	relURL := string(src[start:end])
-	// keep anchor and javascript links intact
-	if relURL == "" || strings.HasPrefix(relURL, "#") || strings.HasPrefix(relURL, "javascript") || strings.HasPrefix(relURL, "data") {
-		return src
-	}
-	// Check if url is relative and make it absolute
-	if strings.Index(relURL, "http") != 0 {
-		relPath, err := url.Parse(relURL)
-		if err != nil {
-			return src
-		}
-		absURL := pm.uri.ResolveReference(relPath).String()
-		src = bytes.Replace(src, []byte(relURL), []byte(absURL), -1)
-		end = start + len(absURL)
+	for _, h := range dropHeaders {
+		dst.Del(h)
 	}
-	encodedString := encodeURL(src[start:end])
-	return bytes.Replace(src, src[start:end], []byte(encodedString), -1)
 }
 
 // Cache templates
@@ -294,16 +293,41 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	allowPrivate := flag.Bool("allow-private", false, "allow proxying to hosts that resolve to a private, loopback or link-local address")
+	flag.Parse()
+
 	httpHost := os.Getenv("HOST")
 	httpPort := os.Getenv("PORT")
 	if httpPort == "" {
 		httpPort = "8080"
 	}
 
-	sessionManager = NewManager("gopee", 600) // client session expiry set to 600s (10mins)
+	wsProxyEnabled = os.Getenv("GOPEE_DISABLE_WS") == ""
+
+	RegisterFilter(&HostFilter{
+		Allow:        splitAndTrim(os.Getenv("GOPEE_HOST_ALLOW")),
+		Deny:         splitAndTrim(os.Getenv("GOPEE_HOST_DENY")),
+		AllowPrivate: *allowPrivate,
+	})
+	RegisterFilter(&MIMEFilter{
+		Allow: splitAndTrim(os.Getenv("GOPEE_MIME_ALLOW")),
+		Deny:  splitAndTrim(os.Getenv("GOPEE_MIME_DENY")),
+	})
+	RegisterFilter(&MaxSizeFilter{MaxBytes: maxResponseSize()})
+
+	providerName := os.Getenv("GOPEE_SESSION_PROVIDER")
+	if providerName == "" {
+		providerName = "memory"
+	}
+	var err error
+	sessionManager, err = NewManager(providerName, os.Getenv("GOPEE_SESSION_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
 	go sessionManager.GC()
 
 	http.HandleFunc("/", homeHandler)
+	http.HandleFunc("/settings", settingsHandler)
 
 	http.HandleFunc("/assets/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, r.URL.Path[1:])
@@ -0,0 +1,39 @@
+package main
+
+// Provider is a pluggable session storage backend. It mirrors Beego's
+// session module so operators can swap the in-process store for something
+// that survives restarts or is shared across instances behind a load
+// balancer, without touching Manager or any of the proxy code.
+type Provider interface {
+	SessionInit(sid string) (Store, error)
+	SessionRead(sid string) (Store, error)
+	SessionRegenerate(oldsid, sid string) (Store, error)
+	SessionDestroy(sid string) error
+	SessionGC(maxLifetime int64)
+}
+
+// Store holds the data for a single session - in Gopee's case this is just
+// the http.Client assigned to that browser. SessionID/Release let the
+// Manager identify and persist the store once it's done with it.
+type Store interface {
+	Set(key, value interface{}) error
+	Get(key interface{}) interface{}
+	Delete(key interface{}) error
+	SessionID() string
+	Release() error
+}
+
+var providers = make(map[string]Provider)
+
+// RegisterProvider makes a session Provider available under name, so
+// NewManager can look it up by its providerName argument. It panics if
+// called twice for the same name, the same way database/sql.Register does.
+func RegisterProvider(name string, provider Provider) {
+	if provider == nil {
+		panic("session: RegisterProvider provider is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("session: RegisterProvider called twice for provider " + name)
+	}
+	providers[name] = provider
+}
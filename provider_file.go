@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileProviderConfig is the shape expected in the providerConfig JSON blob
+// passed to NewManager when provider is "file".
+type fileProviderConfig struct {
+	SavePath string `json:"savePath"`
+}
+
+// fileStore is the Store backing the "file" provider. The live http.Client
+// is rebuilt on SessionInit/SessionRead from the gob file on disk, if any,
+// and the cookie jar is snapshotted back to disk on Release.
+type fileStore struct {
+	mu           sync.Mutex
+	sid          string
+	lastAccessed time.Time
+	client       *http.Client
+	jar          *persistentJar
+	options      SessionOptions
+	provider     *fileProvider
+}
+
+func (s *fileStore) Set(key, value interface{}) error {
+	switch key {
+	case "httpClient":
+		return errors.New("session: httpClient is managed by the provider")
+	case "options":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.options = value.(SessionOptions)
+	}
+	return nil
+}
+
+func (s *fileStore) Get(key interface{}) interface{} {
+	switch key {
+	case "httpClient":
+		return s.client
+	case "options":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.options
+	}
+	return nil
+}
+
+func (s *fileStore) Delete(key interface{}) error {
+	return nil
+}
+
+func (s *fileStore) SessionID() string {
+	return s.sid
+}
+
+// Release persists the current cookie jar to its gob file on disk.
+func (s *fileStore) Release() error {
+	return s.provider.save(s)
+}
+
+// fileProvider gob-serializes each session's cookie jar under SavePath, so
+// that a user's jar survives a restart or is shared across instances that
+// point at the same directory (e.g. a shared volume). It also keeps the
+// live *fileStore for every sid currently in use in cache: a page load
+// fires many concurrent subresource requests through the same session, and
+// without a shared, cacheLock-guarded store each of those would rebuild its
+// own http.Client/jar from the same on-disk snapshot and then clobber each
+// other's cookies on Release, silently dropping login/session cookies.
+type fileProvider struct {
+	lock      sync.Mutex
+	savePath  string
+	cacheLock sync.Mutex
+	cache     map[string]*fileStore
+}
+
+func init() {
+	RegisterProvider("file", &fileProvider{})
+}
+
+func (p *fileProvider) configure(rawConfig string) error {
+	var cfg fileProviderConfig
+	if err := json.Unmarshal([]byte(rawConfig), &cfg); err != nil {
+		return err
+	}
+	if cfg.SavePath == "" {
+		return errors.New("session: file provider requires a savePath")
+	}
+	p.savePath = cfg.SavePath
+	return os.MkdirAll(p.savePath, 0700)
+}
+
+func (p *fileProvider) path(sid string) string {
+	return filepath.Join(p.savePath, sid+".gob")
+}
+
+func (p *fileProvider) SessionInit(sid string) (Store, error) {
+	log.Println("SESSION::CREATE", sid)
+	client, jar := p.newClient()
+	store := &fileStore{sid: sid, lastAccessed: time.Now(), client: client, jar: jar, provider: p}
+	p.cachePut(sid, store)
+	return store, nil
+}
+
+// SessionRead returns the cached *fileStore for sid if one is already live,
+// so concurrent requests in the same session share one jar instead of each
+// reading the on-disk snapshot and racing to write it back. It only hits
+// disk on a cache miss, e.g. just after a restart.
+func (p *fileProvider) SessionRead(sid string) (Store, error) {
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+
+	if store, ok := p.cache[sid]; ok {
+		store.lastAccessed = time.Now()
+		return store, nil
+	}
+
+	p.lock.Lock()
+	f, err := os.Open(p.path(sid))
+	p.lock.Unlock()
+	if err != nil {
+		return nil, errors.New("session: no such session")
+	}
+	defer f.Close()
+
+	var snapshot map[string][]*http.Cookie
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	jar := restoreJar(snapshot)
+	client := &http.Client{CheckRedirect: redirectPolicy, Jar: jar, Transport: newTransportBox(defaultTransport())}
+	store := &fileStore{sid: sid, lastAccessed: time.Now(), client: client, jar: jar, provider: p}
+	p.cacheSet(sid, store)
+	return store, nil
+}
+
+func (p *fileProvider) SessionRegenerate(oldsid, sid string) (Store, error) {
+	store, err := p.SessionRead(oldsid)
+	if err != nil {
+		return p.SessionInit(sid)
+	}
+	fs := store.(*fileStore)
+
+	p.cacheLock.Lock()
+	delete(p.cache, oldsid)
+	fs.sid = sid
+	p.cacheSet(sid, fs)
+	p.cacheLock.Unlock()
+
+	p.SessionDestroy(oldsid)
+	if err := p.save(fs); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (p *fileProvider) SessionDestroy(sid string) error {
+	p.cacheLock.Lock()
+	delete(p.cache, sid)
+	p.cacheLock.Unlock()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return os.Remove(p.path(sid))
+}
+
+// cachePut and cacheSet both add store to the cache under sid - cachePut
+// takes cacheLock itself, cacheSet assumes the caller already holds it (so
+// it can be used while already inside a cacheLock-guarded block).
+func (p *fileProvider) cachePut(sid string, store *fileStore) {
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+	p.cacheSet(sid, store)
+}
+
+func (p *fileProvider) cacheSet(sid string, store *fileStore) {
+	if p.cache == nil {
+		p.cache = make(map[string]*fileStore)
+	}
+	p.cache[sid] = store
+}
+
+func (p *fileProvider) save(s *fileStore) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f, err := os.Create(p.path(s.sid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(s.jar.Snapshot())
+}
+
+// SessionGC removes any gob file that hasn't been touched in maxLifetime
+// seconds, using its mtime as a stand-in for lastAccessed, and evicts the
+// same sids from cache. The cache eviction happens after lock is released
+// (never nested under it) since SessionRead takes the two locks in the
+// opposite order and nesting them here would risk a deadlock.
+func (p *fileProvider) SessionGC(maxLifetime int64) {
+	p.lock.Lock()
+	entries, err := os.ReadDir(p.savePath)
+	if err != nil {
+		p.lock.Unlock()
+		return
+	}
+	var expired []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Unix()+maxLifetime < time.Now().Unix() {
+			os.Remove(filepath.Join(p.savePath, entry.Name()))
+			expired = append(expired, strings.TrimSuffix(entry.Name(), ".gob"))
+		}
+	}
+	p.lock.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+	for _, sid := range expired {
+		delete(p.cache, sid)
+	}
+}
+
+func (p *fileProvider) newClient() (*http.Client, *persistentJar) {
+	jar := newPersistentJar()
+	return &http.Client{CheckRedirect: redirectPolicy, Jar: jar, Transport: newTransportBox(defaultTransport())}, jar
+}
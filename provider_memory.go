@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
+	"time"
+)
+
+// memStore is the Store implementation backing the "memory" provider. It
+// keeps the live http.Client in a plain map entry, the same thing Manager
+// used to do directly before providers existed.
+type memStore struct {
+	mu           sync.Mutex
+	sid          string
+	lastAccessed time.Time
+	data         map[interface{}]interface{}
+	provider     *memProvider
+}
+
+func (s *memStore) Set(key, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+	return nil
+}
+
+func (s *memStore) Get(key interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key]
+}
+
+func (s *memStore) Delete(key interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+func (s *memStore) SessionID() string {
+	return s.sid
+}
+
+// Release just bumps lastAccessed - there's nothing to flush to disk.
+func (s *memStore) Release() error {
+	s.provider.touch(s.sid)
+	return nil
+}
+
+// memProvider keeps every session in an in-process list, preserving Gopee's
+// original behavior. It is selected with the provider name "memory".
+type memProvider struct {
+	lock    sync.RWMutex
+	clients map[string]*list.Element
+	list    *list.List
+}
+
+func newMemProvider() *memProvider {
+	return &memProvider{clients: make(map[string]*list.Element), list: list.New()}
+}
+
+func (p *memProvider) SessionInit(sid string) (Store, error) {
+	log.Println("SESSION::CREATE")
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	cookieJar, _ := cookiejar.New(nil)
+	client := &http.Client{CheckRedirect: redirectPolicy, Jar: cookieJar, Transport: newTransportBox(defaultTransport())}
+	store := &memStore{
+		sid:          sid,
+		lastAccessed: time.Now(),
+		data:         map[interface{}]interface{}{"httpClient": client},
+		provider:     p,
+	}
+	element := p.list.PushBack(store)
+	p.clients[sid] = element
+	return store, nil
+}
+
+func (p *memProvider) SessionRead(sid string) (Store, error) {
+	log.Println("SESSION::GET", sid)
+	p.lock.RLock()
+	element, ok := p.clients[sid]
+	p.lock.RUnlock()
+	if !ok {
+		return nil, errors.New("session: no such session")
+	}
+	go p.touch(sid)
+	return element.Value.(*memStore), nil
+}
+
+func (p *memProvider) SessionRegenerate(oldsid, sid string) (Store, error) {
+	p.lock.Lock()
+	element, ok := p.clients[oldsid]
+	if !ok {
+		p.lock.Unlock()
+		return p.SessionInit(sid)
+	}
+	store := element.Value.(*memStore)
+	store.sid = sid
+	delete(p.clients, oldsid)
+	p.clients[sid] = element
+	p.lock.Unlock()
+	return store, nil
+}
+
+func (p *memProvider) SessionDestroy(sid string) error {
+	log.Println("SESSION::DESTROY", sid)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if element, ok := p.clients[sid]; ok {
+		delete(p.clients, sid)
+		p.list.Remove(element)
+	}
+	return nil
+}
+
+func (p *memProvider) touch(sid string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if element, ok := p.clients[sid]; ok {
+		element.Value.(*memStore).lastAccessed = time.Now()
+		p.list.MoveToFront(element)
+	}
+}
+
+// SessionGC removes clients that have been idle for longer than maxLifetime.
+// Stale sessions are always found at the back of the list.
+func (p *memProvider) SessionGC(maxLifetime int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		element := p.list.Back()
+		if element == nil {
+			break
+		}
+		store := element.Value.(*memStore)
+		if store.lastAccessed.Unix()+maxLifetime < time.Now().Unix() {
+			log.Println("REMOVE", store.sid)
+			delete(p.clients, store.sid)
+			p.list.Remove(element)
+		} else {
+			break
+		}
+	}
+}
+
+func init() {
+	RegisterProvider("memory", newMemProvider())
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisProviderConfig is the shape expected in the providerConfig JSON blob
+// passed to NewManager when provider is "redis".
+type redisProviderConfig struct {
+	Addr      string `json:"addr"`
+	Password  string `json:"password"`
+	DB        int    `json:"db"`
+	KeyPrefix string `json:"keyPrefix"`
+}
+
+// redisStore is the Store backing the "redis" provider - it behaves exactly
+// like fileStore except the cookie jar snapshot is kept in a redis key
+// instead of a file, which is what lets several Gopee instances behind a
+// load balancer share sessions.
+type redisStore struct {
+	mu       sync.Mutex
+	sid      string
+	client   *http.Client
+	jar      *persistentJar
+	options  SessionOptions
+	provider *redisProvider
+}
+
+func (s *redisStore) Set(key, value interface{}) error {
+	switch key {
+	case "httpClient":
+		return errors.New("session: httpClient is managed by the provider")
+	case "options":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.options = value.(SessionOptions)
+	}
+	return nil
+}
+
+func (s *redisStore) Get(key interface{}) interface{} {
+	switch key {
+	case "httpClient":
+		return s.client
+	case "options":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.options
+	}
+	return nil
+}
+
+func (s *redisStore) Delete(key interface{}) error { return nil }
+
+func (s *redisStore) SessionID() string { return s.sid }
+
+func (s *redisStore) Release() error {
+	return s.provider.save(s)
+}
+
+// redisProvider keeps each session's cookie jar snapshot as a gob blob
+// under "<keyPrefix><sid>" in redis, with a TTL equal to maxLifetime so
+// idle sessions expire on their own without a separate GC sweep. It also
+// keeps the live *redisStore for every sid currently in use in cache, the
+// same reason fileProvider does: a page load fires many concurrent
+// subresource requests through one session, and without a shared,
+// cacheLock-guarded store each would rebuild its own jar from the same
+// redis snapshot and clobber each other's cookies on Release.
+type redisProvider struct {
+	rdb         *redis.Client
+	keyPrefix   string
+	maxLifetime int64
+	cacheLock   sync.Mutex
+	cache       map[string]*redisStore
+}
+
+func init() {
+	RegisterProvider("redis", &redisProvider{})
+}
+
+func (p *redisProvider) configure(rawConfig string) error {
+	var cfg redisProviderConfig
+	if err := json.Unmarshal([]byte(rawConfig), &cfg); err != nil {
+		return err
+	}
+	if cfg.Addr == "" {
+		return errors.New("session: redis provider requires an addr")
+	}
+	p.keyPrefix = cfg.KeyPrefix
+	if p.keyPrefix == "" {
+		p.keyPrefix = "gopee:session:"
+	}
+	p.rdb = redis.NewClient(&redis.Options{Addr: cfg.Addr, Password: cfg.Password, DB: cfg.DB})
+	return p.rdb.Ping(context.Background()).Err()
+}
+
+func (p *redisProvider) key(sid string) string {
+	return p.keyPrefix + sid
+}
+
+func (p *redisProvider) SessionInit(sid string) (Store, error) {
+	log.Println("SESSION::CREATE", sid)
+	jar := newPersistentJar()
+	client := &http.Client{CheckRedirect: redirectPolicy, Jar: jar, Transport: newTransportBox(defaultTransport())}
+	store := &redisStore{sid: sid, client: client, jar: jar, provider: p}
+
+	p.cacheLock.Lock()
+	p.cacheSet(sid, store)
+	p.cacheLock.Unlock()
+
+	return store, nil
+}
+
+// SessionRead returns the cached *redisStore for sid if one is already
+// live, so concurrent requests in the same session share one jar instead
+// of each reading the redis snapshot and racing to write it back. It only
+// hits redis on a cache miss, e.g. just after a restart.
+func (p *redisProvider) SessionRead(sid string) (Store, error) {
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+
+	if store, ok := p.cache[sid]; ok {
+		return store, nil
+	}
+
+	raw, err := p.rdb.Get(context.Background(), p.key(sid)).Bytes()
+	if err != nil {
+		return nil, errors.New("session: no such session")
+	}
+	snapshot, err := decodeJarSnapshot(raw)
+	if err != nil {
+		return nil, err
+	}
+	jar := restoreJar(snapshot)
+	client := &http.Client{CheckRedirect: redirectPolicy, Jar: jar, Transport: newTransportBox(defaultTransport())}
+	store := &redisStore{sid: sid, client: client, jar: jar, provider: p}
+	p.cacheSet(sid, store)
+	return store, nil
+}
+
+func (p *redisProvider) SessionRegenerate(oldsid, sid string) (Store, error) {
+	store, err := p.SessionRead(oldsid)
+	if err != nil {
+		return p.SessionInit(sid)
+	}
+	rs := store.(*redisStore)
+
+	p.cacheLock.Lock()
+	delete(p.cache, oldsid)
+	rs.sid = sid
+	p.cacheSet(sid, rs)
+	p.cacheLock.Unlock()
+
+	p.SessionDestroy(oldsid)
+	if err := p.save(rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (p *redisProvider) SessionDestroy(sid string) error {
+	p.cacheLock.Lock()
+	delete(p.cache, sid)
+	p.cacheLock.Unlock()
+
+	return p.rdb.Del(context.Background(), p.key(sid)).Err()
+}
+
+// cacheSet assumes the caller already holds cacheLock.
+func (p *redisProvider) cacheSet(sid string, store *redisStore) {
+	if p.cache == nil {
+		p.cache = make(map[string]*redisStore)
+	}
+	p.cache[sid] = store
+}
+
+func (p *redisProvider) save(s *redisStore) error {
+	raw, err := encodeJarSnapshot(s.jar.Snapshot())
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(p.maxLifetime) * time.Second
+	return p.rdb.Set(context.Background(), p.key(s.sid), raw, ttl).Err()
+}
+
+// SessionGC records maxLifetime as the TTL save sets on each key - redis
+// expires idle sessions itself via that TTL - and drops from cache every
+// store whose key redis has already expired, so SessionRead stops serving it.
+func (p *redisProvider) SessionGC(maxLifetime int64) {
+	p.maxLifetime = maxLifetime
+
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+	for sid := range p.cache {
+		if n, err := p.rdb.Exists(context.Background(), p.key(sid)).Result(); err == nil && n == 0 {
+			delete(p.cache, sid)
+		}
+	}
+}
+
+func encodeJarSnapshot(snapshot map[string][]*http.Cookie) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeJarSnapshot(raw []byte) (map[string][]*http.Cookie, error) {
+	var snapshot map[string][]*http.Cookie
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/css"
+)
+
+// urlAttrsByTag lists which attributes on which tags carry URLs that need
+// rewriting so the browser routes them back through the proxy.
+var urlAttrsByTag = map[string][]string{
+	"a":      {"href"},
+	"link":   {"href", "imagesrcset"},
+	"img":    {"src", "srcset"},
+	"script": {"src"},
+	"form":   {"action"},
+	"video":  {"src", "poster"},
+	"audio":  {"src"},
+	"source": {"src", "srcset"},
+	"iframe": {"src"},
+}
+
+var reMetaRefreshURL = regexp.MustCompile(`(?i)url\s*=\s*(.*)$`)
+
+// reJSWebSocketURL matches a quoted ws:// or wss:// string literal, so
+// client-side JS that opens its own WebSocket can be redirected through
+// the proxy too.
+var reJSWebSocketURL = regexp.MustCompile(`(["'])(wss?://[^"']*)(["'])`)
+
+// rewriteJSWebSocketURLs rewrites every quoted ws(s):// literal found in a
+// <script> block using rewrite.
+func rewriteJSWebSocketURLs(src string, rewrite urlRewriteFunc) string {
+	return reJSWebSocketURL.ReplaceAllStringFunc(src, func(m string) string {
+		parts := reJSWebSocketURL.FindStringSubmatch(m)
+		return parts[1] + rewrite(parts[2]) + parts[3]
+	})
+}
+
+// defaultRewriteURL resolves raw against pm.uri and encodes it the way
+// Gopee always has. It's the rewriteURL Fetch installs on every
+// proxyManager; tests or future JS-source rewriting can swap in their own.
+func (pm *proxyManager) defaultRewriteURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || strings.HasPrefix(raw, "#") || strings.HasPrefix(raw, "javascript:") || strings.HasPrefix(raw, "data:") {
+		return raw
+	}
+	resolved, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if !resolved.IsAbs() {
+		resolved = pm.uri.ResolveReference(resolved)
+	}
+	return "/" + encodeURL([]byte(resolved.String()))
+}
+
+// rewriteHTML streams the response body through html.Tokenizer, rewriting
+// URL-bearing attributes token by token instead of slurping the whole body
+// into memory and regex-replacing it.
+func (pm *proxyManager) rewriteHTML(w io.Writer, encoding string) {
+	bodyReader, err := decodeBody(pm.resp)
+	if err != nil {
+		log.Println("error decoding body", pm.uri.String(), err.Error())
+		return
+	}
+	defer bodyReader.Close()
+
+	out, err := wrapEncoder(w, encoding)
+	if err != nil {
+		log.Println("error encoding body", pm.uri.String(), err.Error())
+		return
+	}
+	defer out.Close()
+
+	z := html.NewTokenizer(bodyReader)
+	inStyle := false
+	inScript := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != nil && err != io.EOF {
+				log.Println("error tokenizing html", pm.uri.String(), err.Error())
+			}
+			return
+		}
+
+		token := z.Token()
+		switch token.Type {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if token.Data == "base" {
+				pm.adoptBaseHref(&token)
+			}
+			pm.rewriteTagAttrs(&token)
+			if token.Type == html.StartTagToken {
+				inStyle = token.Data == "style"
+				inScript = token.Data == "script"
+			}
+		case html.EndTagToken:
+			if token.Data == "style" {
+				inStyle = false
+			}
+			if token.Data == "script" {
+				inScript = false
+			}
+		case html.TextToken:
+			if inStyle {
+				token.Data = string(pm.rewriteCSSBytes([]byte(token.Data)))
+			}
+			if inScript {
+				// best-effort: only string-literal ws(s):// URLs are caught,
+				// not ones built up dynamically by the page's own JS
+				token.Data = rewriteJSWebSocketURLs(token.Data, pm.rewriteURL)
+			}
+			if inStyle || inScript {
+				// raw-text elements are never HTML-entity-decoded by the
+				// parser, so token.String()'s EscapeString would corrupt
+				// any `"`, `&`, `<` in the script/style verbatim - write
+				// the (possibly rewritten) text back out unescaped
+				io.WriteString(out, token.Data)
+				continue
+			}
+		}
+
+		io.WriteString(out, token.String())
+
+		// expose the XSRF token to page JS right after <head> opens, so it
+		// can be echoed back on state-changing requests
+		if token.Type == html.StartTagToken && token.Data == "head" && pm.xsrfToken != "" {
+			io.WriteString(out, `<meta name="xsrf-token" content="`+pm.xsrfToken+`">`)
+		}
+	}
+}
+
+// adoptBaseHref switches the base URL used to resolve relative links to
+// whatever <base href> the document declares, same as the old regex did.
+func (pm *proxyManager) adoptBaseHref(token *html.Token) {
+	for _, attr := range token.Attr {
+		if attr.Key != "href" {
+			continue
+		}
+		parsed, err := url.Parse(attr.Val)
+		if err != nil {
+			log.Println("error parsing base href", attr.Val)
+			continue
+		}
+		pm.uri = parsed
+	}
+}
+
+// rewriteTagAttrs rewrites every URL-bearing attribute on token in place,
+// covering plain src/href/action as well as srcset, poster, inline style
+// background images and meta-refresh redirects.
+func (pm *proxyManager) rewriteTagAttrs(token *html.Token) {
+	isRefresh := token.Data == "meta" && hasHTTPEquivRefresh(token)
+	for i := range token.Attr {
+		attr := &token.Attr[i]
+		switch {
+		case attr.Key == "style":
+			attr.Val = string(pm.rewriteCSSBytes([]byte(attr.Val)))
+			continue
+		case isRefresh && attr.Key == "content":
+			attr.Val = rewriteMetaRefresh(attr.Val, pm.rewriteURL)
+			continue
+		case strings.HasPrefix(attr.Key, "data-") && (strings.HasPrefix(attr.Val, "ws://") || strings.HasPrefix(attr.Val, "wss://")):
+			attr.Val = pm.rewriteURL(attr.Val)
+			continue
+		}
+
+		for _, urlAttr := range urlAttrsByTag[token.Data] {
+			if attr.Key != urlAttr {
+				continue
+			}
+			if strings.HasSuffix(urlAttr, "srcset") {
+				attr.Val = rewriteSrcset(attr.Val, pm.rewriteURL)
+			} else {
+				attr.Val = pm.rewriteURL(attr.Val)
+			}
+		}
+	}
+}
+
+func hasHTTPEquivRefresh(token *html.Token) bool {
+	for _, attr := range token.Attr {
+		if attr.Key == "http-equiv" && strings.EqualFold(attr.Val, "refresh") {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteMetaRefresh rewrites the url=... portion of a
+// <meta http-equiv="refresh" content="5;url=...">.
+func rewriteMetaRefresh(content string, rewrite urlRewriteFunc) string {
+	return reMetaRefreshURL.ReplaceAllStringFunc(content, func(m string) string {
+		idx := strings.Index(m, "=")
+		return "url=" + rewrite(strings.TrimSpace(m[idx+1:]))
+	})
+}
+
+// rewriteSrcset rewrites each URL in a comma-separated srcset/imagesrcset
+// attribute, leaving the width/density descriptors untouched.
+func rewriteSrcset(val string, rewrite urlRewriteFunc) string {
+	candidates := strings.Split(val, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(strings.TrimSpace(candidate))
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = rewrite(fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// rewriteCSS streams the response body through the tdewolff CSS tokenizer,
+// rewriting url(...) and @import targets, for standalone text/css responses.
+func (pm *proxyManager) rewriteCSS(w io.Writer, encoding string) {
+	bodyReader, err := decodeBody(pm.resp)
+	if err != nil {
+		log.Println("error decoding body", pm.uri.String(), err.Error())
+		return
+	}
+	defer bodyReader.Close()
+
+	out, err := wrapEncoder(w, encoding)
+	if err != nil {
+		log.Println("error encoding body", pm.uri.String(), err.Error())
+		return
+	}
+	defer out.Close()
+
+	pm.streamCSS(css.NewLexer(parse.NewInput(bodyReader)), out)
+}
+
+// rewriteCSSBytes runs the same tokenizer over an in-memory chunk of CSS,
+// used for inline <style> blocks and style="" attributes.
+func (pm *proxyManager) rewriteCSSBytes(src []byte) []byte {
+	var out strings.Builder
+	pm.streamCSS(css.NewLexer(parse.NewInputBytes(src)), &out)
+	return []byte(out.String())
+}
+
+func (pm *proxyManager) streamCSS(lexer *css.Lexer, out io.Writer) {
+	afterImport := false
+	for {
+		tt, text := lexer.Next()
+		if tt == css.ErrorToken {
+			return
+		}
+		switch tt {
+		case css.URLToken:
+			out.Write(rewriteCSSURLToken(text, pm.rewriteURL))
+			afterImport = false
+		case css.StringToken:
+			if afterImport {
+				out.Write(rewriteCSSStringToken(text, pm.rewriteURL))
+			} else {
+				out.Write(text)
+			}
+			afterImport = false
+		case css.AtKeywordToken:
+			afterImport = strings.EqualFold(string(text), "@import")
+			out.Write(text)
+		default:
+			out.Write(text)
+		}
+	}
+}
+
+// rewriteCSSURLToken rewrites the contents of a url(...) token, preserving
+// whatever quoting (none, ' or ") the original used.
+func rewriteCSSURLToken(token []byte, rewrite urlRewriteFunc) []byte {
+	inner := strings.TrimSuffix(strings.TrimPrefix(string(token), "url("), ")")
+	inner = strings.TrimSpace(inner)
+	quote := ""
+	if len(inner) > 0 && (inner[0] == '"' || inner[0] == '\'') {
+		quote = string(inner[0])
+		inner = strings.Trim(inner, quote)
+	}
+	return []byte("url(" + quote + rewrite(inner) + quote + ")")
+}
+
+// rewriteCSSStringToken rewrites a quoted string token, used for the
+// @import "url" form.
+func rewriteCSSStringToken(token []byte, rewrite urlRewriteFunc) []byte {
+	quote := string(token[0])
+	inner := strings.Trim(string(token), quote)
+	return []byte(quote + rewrite(inner) + quote)
+}
@@ -1,44 +1,47 @@
 /*
 Creates a new session for every user / browser
-Each session has a http client assigned with its own cookie jar
+Each session has a http client assigned with its own cookie jar, persisted
+through a pluggable Provider (memory, file or redis)
 */
 
 package main
 
 import (
-	"container/list"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io"
-	"log"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
-	"sync"
 	"time"
 )
 
-// ClientStore holds the sessionId for the session and the related http client
-// lastAccessed time is used for expiry
-type ClientStore struct {
-	sessionId    string
-	lastAccessed time.Time
-	httpClient   *http.Client
+// managerConfig is the shape of the JSON config string passed to NewManager.
+type managerConfig struct {
+	CookieName     string `json:"cookieName"`
+	Gclifetime     int64  `json:"gclifetime"`
+	ProviderConfig string `json:"providerConfig"`
 }
 
 type Manager struct {
 	cookieName  string
-	clients     map[string]*list.Element
-	list        *list.List
+	provider    Provider
 	maxLifetime int64
-	lock        sync.RWMutex
 }
 
+// redirectPolicy caps the hop count, carries the original request's headers
+// onto each hop, and re-runs the request filter chain against every hop's
+// URL - without that, a target could 302 a proxied request to a private or
+// denied host and slip past the SSRF guard HostFilter only applies to the
+// request's initial URL.
 func redirectPolicy(req *http.Request, via []*http.Request) error {
 	if len(via) >= 10 {
 		return errors.New("too many redirects")
 	}
+	if err := runRequestFilters(req); err != nil {
+		return err
+	}
 	if len(via) == 0 {
 		return nil
 	}
@@ -51,114 +54,166 @@ func redirectPolicy(req *http.Request, via []*http.Request) error {
 	return nil
 }
 
-func NewManager(cookieName string, maxLifetime int64) *Manager {
-	clients := make(map[string]*list.Element)
-	return &Manager{cookieName: cookieName, clients: clients, list: list.New(), maxLifetime: maxLifetime}
+// NewManager looks up the registered Provider by name (see RegisterProvider)
+// and configures it from rawConfig, a JSON string of the form
+// {"cookieName":"gopee","gclifetime":600,"providerConfig":"..."}.
+// providerConfig is opaque to Manager and is passed straight through to the
+// provider, which interprets it however it needs (e.g. a redis addr or a
+// file savePath).
+func NewManager(providerName string, rawConfig string) (*Manager, error) {
+	provider, ok := providers[providerName]
+	if !ok {
+		return nil, errors.New("session: unknown provider " + providerName)
+	}
+
+	cfg := managerConfig{CookieName: "gopee", Gclifetime: 600}
+	if rawConfig != "" {
+		if err := json.Unmarshal([]byte(rawConfig), &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if configurable, ok := provider.(interface{ configure(string) error }); ok && cfg.ProviderConfig != "" {
+		if err := configurable.configure(cfg.ProviderConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Manager{cookieName: cfg.CookieName, provider: provider, maxLifetime: cfg.Gclifetime}, nil
 }
 
 // Start will read the session cookie if it exists and retrieve the http client assigned,
-// if a session does not exist or is expired, a new session will be created
-func (manager *Manager) Start(w http.ResponseWriter, r *http.Request) (httpClient *http.Client, err error) {
-	var clientStore *ClientStore
+// if a session does not exist, is expired, or fails signature verification, a new
+// session will be created. The session's XSRF token is exposed on XSRFHeader so the
+// page can echo it back on state-changing requests.
+func (manager *Manager) Start(w http.ResponseWriter, r *http.Request) (httpClient *http.Client, sid string, err error) {
+	var store Store
+	if existing, ok := manager.SID(r); ok {
+		store = manager.Get(existing)
+		sid = existing
+	}
+	if store == nil {
+		// session cookie missing, expired, or tampered with
+		store, err = manager.Create()
+		if err != nil {
+			return nil, "", err
+		}
+		sid = store.SessionID()
+		manager.setCookie(sid, w, r)
+	}
+	defer store.Release()
+	w.Header().Set(XSRFHeader, xsrfToken(sid))
+	return store.Get("httpClient").(*http.Client), sid, nil
+}
+
+// SID returns the session id the caller presented, provided its signed
+// cookie is present and verifies correctly.
+func (manager *Manager) SID(r *http.Request) (string, bool) {
 	cookie, err := r.Cookie(manager.cookieName)
 	if err != nil || cookie.Value == "" {
-		// session cookie not found
-		clientStore = manager.Create()
-		manager.setCookie(clientStore.sessionId, w)
-		return clientStore.httpClient, nil
-	} else {
-		// session cookie found
-		sid, errs := url.QueryUnescape(cookie.Value)
-		if errs != nil {
-			return nil, errs
-		}
-		clientStore = manager.Get(sid)
-		if clientStore == nil {
-			// session expired
-			clientStore = manager.Create()
-			manager.setCookie(clientStore.sessionId, w)
-		}
-		return clientStore.httpClient, nil
+		return "", false
+	}
+	unescaped, err := url.QueryUnescape(cookie.Value)
+	if err != nil {
+		return "", false
+	}
+	sid, err := verifySID(unescaped)
+	if err != nil {
+		return "", false
 	}
+	return sid, true
 }
 
-func (manager *Manager) setCookie(sid string, w http.ResponseWriter) {
+// Regenerate swaps in a fresh session id for the caller's current session,
+// keeping the same Store (and therefore cookie jar). Call this after a
+// redirect that looks like a login flow to blunt session fixation attacks.
+func (manager *Manager) Regenerate(w http.ResponseWriter, r *http.Request) error {
+	oldsid, ok := manager.SID(r)
+	if !ok {
+		return errors.New("session: no session to regenerate")
+	}
+	newsid := generateSessionId(32)
+	store, err := manager.provider.SessionRegenerate(oldsid, newsid)
+	if err != nil {
+		return err
+	}
+	defer store.Release()
+	manager.setCookie(newsid, w, r)
+	return nil
+}
+
+func (manager *Manager) setCookie(sid string, w http.ResponseWriter, r *http.Request) {
 	cookie := &http.Cookie{
 		Name:     manager.cookieName,
-		Value:    sid,
+		Value:    signSID(sid),
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   r.TLS != nil,
 	}
 	http.SetCookie(w, cookie)
 }
 
-// Create will create a new client store
-func (manager *Manager) Create() *ClientStore {
-	log.Println("SESSION::CREATE")
-	manager.lock.Lock()
-	defer manager.lock.Unlock()
-	cookieJar, _ := cookiejar.New(nil)
-	client := &http.Client{CheckRedirect: redirectPolicy, Jar: cookieJar}
-	sid := generateSessionId(32)
-	clientStore := &ClientStore{sessionId: sid, lastAccessed: time.Now(), httpClient: client}
-	element := manager.list.PushBack(clientStore)
-	manager.clients[sid] = element
-	return clientStore
+// Create will create a new session store via the configured provider
+func (manager *Manager) Create() (Store, error) {
+	return manager.provider.SessionInit(generateSessionId(32))
 }
 
-// Get will try to get the existing session
-func (manager *Manager) Get(sid string) *ClientStore {
-	log.Println("SESSION::GET", sid)
-	manager.lock.RLock()
-	defer manager.lock.RUnlock()
-	if element, ok := manager.clients[sid]; ok {
-		go manager.Update(sid)
-		return element.Value.(*ClientStore)
+// Get will try to get the existing session from the configured provider
+func (manager *Manager) Get(sid string) Store {
+	store, err := manager.provider.SessionRead(sid)
+	if err != nil {
+		return nil
 	}
-	return nil
+	return store
 }
 
 func (manager *Manager) Destroy(sid string) {
-	log.Println("SESSION::DESTROY", sid)
-	manager.lock.Lock()
-	defer manager.lock.Unlock()
-	if element, ok := manager.clients[sid]; ok {
-		delete(manager.clients, sid)
-		manager.list.Remove(element)
+	manager.provider.SessionDestroy(sid)
+}
+
+// Options returns the SessionOptions previously applied to sid via
+// ApplyOptions, or the zero value if none have been set.
+func (manager *Manager) Options(sid string) SessionOptions {
+	store := manager.Get(sid)
+	if store == nil {
+		return SessionOptions{}
 	}
+	defer store.Release()
+	if opts, ok := store.Get("options").(SessionOptions); ok {
+		return opts
+	}
+	return SessionOptions{}
 }
 
-func (manager *Manager) Update(sid string) {
-	log.Println("SESSION::UPDATE", sid)
-	manager.lock.Lock()
-	defer manager.lock.Unlock()
-	if element, ok := manager.clients[sid]; ok {
-		element.Value.(*ClientStore).lastAccessed = time.Now()
-		manager.list.MoveToFront(element)
+// ApplyOptions reconfigures the caller's session Transport according to
+// opts, letting a user route their browsing through their own upstream
+// proxy and identity without restarting Gopee or affecting other sessions.
+func (manager *Manager) ApplyOptions(r *http.Request, opts SessionOptions) error {
+	sid, ok := manager.SID(r)
+	if !ok {
+		return errors.New("session: no session to configure")
+	}
+	store := manager.Get(sid)
+	if store == nil {
+		return errors.New("session: no such session")
+	}
+	defer store.Release()
+
+	transport, err := buildTransport(opts)
+	if err != nil {
+		return err
 	}
+	box, ok := store.Get("httpClient").(*http.Client).Transport.(*transportBox)
+	if !ok {
+		return errors.New("session: httpClient has no transportBox to configure")
+	}
+	box.swap(transport)
+	return store.Set("options", opts)
 }
 
-// clean clients for expired sessions
+// GC asks the provider to clean up expired sessions, then reschedules itself.
 func (manager *Manager) GC() {
-	log.Println("SESSION::GC")
-	manager.lock.Lock()
-	defer manager.lock.Unlock()
-	// iterate until all expired sessions are removed
-	for {
-		// stale sessions are found at the back of the list
-		element := manager.list.Back()
-		// list is empty
-		if element == nil {
-			break
-		}
-		if (element.Value.(*ClientStore).lastAccessed.Unix() + manager.maxLifetime) < time.Now().Unix() {
-			log.Println("REMOVE", element.Value.(*ClientStore).sessionId)
-			delete(manager.clients, element.Value.(*ClientStore).sessionId)
-			manager.list.Remove(element)
-		} else {
-			break
-		}
-	}
+	manager.provider.SessionGC(manager.maxLifetime)
 	time.AfterFunc(time.Duration(manager.maxLifetime)*time.Second, func() { manager.GC() })
 }
 
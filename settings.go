@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"golang.org/x/net/proxy"
+)
+
+// SessionOptions configures how a session's upstream requests go out:
+// through which proxy, under which identity, and with which headers
+// stripped - so one Gopee instance can serve several users each with their
+// own egress, e.g. one user routed through Tor and another through a
+// residential proxy.
+type SessionOptions struct {
+	ProxyURL     string   `json:"proxyURL"`
+	UserAgent    string   `json:"userAgent"`
+	Referer      string   `json:"referer"`
+	StripReferer bool     `json:"stripReferer"`
+	DropHeaders  []string `json:"dropHeaders"`
+}
+
+// settingsTemplate is the form users fill in to configure their session.
+var settingsTemplate = template.Must(template.ParseFiles("settings.html"))
+
+// settingsHandler renders the settings form on GET and applies the posted
+// SessionOptions to the caller's session on POST.
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		settingsTemplate.ExecuteTemplate(w, "settings.html", nil)
+	case http.MethodPost:
+		if !verifyXSRF(r) {
+			http.Error(w, "invalid or missing XSRF token", http.StatusForbidden)
+			return
+		}
+
+		var opts SessionOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sessionManager.ApplyOptions(r, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// transportBox is the RoundTripper every session's http.Client is built
+// with. ApplyOptions can be called concurrently with requests already in
+// flight on that same client, so it must never mutate http.Client.Transport
+// directly - that field isn't safe to swap while Do is reading it elsewhere.
+// Instead the client's Transport is set once, at creation, to a transportBox,
+// and ApplyOptions only ever swaps what's stored inside it.
+type transportBox struct {
+	rt atomic.Value // http.RoundTripper
+}
+
+func newTransportBox(rt http.RoundTripper) *transportBox {
+	box := &transportBox{}
+	box.rt.Store(rt)
+	return box
+}
+
+func (b *transportBox) RoundTrip(req *http.Request) (*http.Response, error) {
+	return b.rt.Load().(http.RoundTripper).RoundTrip(req)
+}
+
+func (b *transportBox) swap(rt http.RoundTripper) {
+	b.rt.Store(rt)
+}
+
+// sessionTransport wraps a RoundTripper to apply a session's egress
+// policy: spoofed/stripped Referer and a User-Agent override. Header
+// dropping for the forwarded request lives in copyHeader instead, since
+// that's where the rest of Gopee's header scrubbing already happens.
+type sessionTransport struct {
+	next    http.RoundTripper
+	options SessionOptions
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.options.UserAgent != "" {
+		req.Header.Set("User-Agent", t.options.UserAgent)
+	}
+	switch {
+	case t.options.Referer != "":
+		req.Header.Set("Referer", t.options.Referer)
+	case t.options.StripReferer:
+		req.Header.Del("Referer")
+	}
+	return t.next.RoundTrip(req)
+}
+
+// buildTransport resolves opts.ProxyURL (socks5://, http:// or https://) and
+// returns a RoundTripper that chains through it, wrapped with the session's
+// Referer/User-Agent policy.
+func buildTransport(opts SessionOptions) (http.RoundTripper, error) {
+	var base http.RoundTripper = defaultTransport()
+
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		switch proxyURL.Scheme {
+		case "socks5":
+			dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+			if err != nil {
+				return nil, err
+			}
+			base = &http.Transport{Dial: dialer.Dial}
+		case "http", "https":
+			base = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+		default:
+			return nil, errors.New("settings: unsupported proxy scheme " + proxyURL.Scheme)
+		}
+	}
+
+	return &sessionTransport{next: base, options: opts}, nil
+}
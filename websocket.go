@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// wsProxyEnabled toggles WebSocket hijacking in ProxyRequest. Operators who
+// don't want Gopee holding long-lived hijacked connections can disable it
+// by setting GOPEE_DISABLE_WS=1.
+var wsProxyEnabled = true
+
+// isWebSocketUpgrade reports whether r is asking to upgrade to WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// proxyWebSocket hijacks the client connection, dials target directly (a
+// plain http.RoundTrip can't carry a protocol upgrade) and relays the
+// handshake followed by raw frames in both directions until either side
+// closes. If the caller has a session, the dial honors that session's
+// configured SessionOptions.ProxyURL and the handshake carries that
+// session's own cookies for target, the same as an ordinary proxied request
+// would get via httpClient.
+func proxyWebSocket(w http.ResponseWriter, r *http.Request, target *url.URL) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket proxying not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var opts SessionOptions
+	var jar http.CookieJar
+	if sid, ok := sessionManager.SID(r); ok {
+		if store := sessionManager.Get(sid); store != nil {
+			opts = sessionManager.Options(sid)
+			jar = store.Get("httpClient").(*http.Client).Jar
+			store.Release()
+		}
+	}
+
+	upstream, err := dialWebSocketTarget(target, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	handshake := r.Clone(r.Context())
+	handshake.URL = target
+	handshake.Host = target.Host
+	handshake.RequestURI = ""
+	rewriteWebSocketHandshakeHeaders(handshake.Header, target, jar)
+
+	if err := handshake.Write(upstream); err != nil {
+		log.Println("error forwarding websocket handshake to", target.String(), err.Error())
+		return
+	}
+
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Println("error hijacking connection for websocket", target.String(), err.Error())
+		return
+	}
+	defer client.Close()
+
+	relayWebSocket(client, upstream)
+}
+
+// dialWebSocketTarget dials target, routing through opts.ProxyURL if set so
+// a session's configured egress applies to its WebSocket traffic too, not
+// just the requests that go through httpClient.
+func dialWebSocketTarget(target *url.URL, opts SessionOptions) (net.Conn, error) {
+	host := target.Host
+	if !strings.Contains(host, ":") {
+		if target.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	conn, err := dialThroughProxy(opts.ProxyURL, host)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "wss" {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: target.Hostname()})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialThroughProxy dials addr directly, or through proxyURL (socks5://,
+// http:// or https://) when one is set - the same schemes buildTransport
+// supports for ordinary proxied requests.
+func dialThroughProxy(proxyURL, addr string) (net.Conn, error) {
+	if proxyURL == "" {
+		return safeDialContext(context.Background(), "tcp", addr)
+	}
+
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "socks5":
+		dialer, err := proxy.FromURL(parsed, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial("tcp", addr)
+	case "http", "https":
+		return dialViaHTTPConnect(parsed, addr)
+	default:
+		return nil, errors.New("websocket: unsupported proxy scheme " + parsed.Scheme)
+	}
+}
+
+// dialViaHTTPConnect tunnels a raw connection to addr through an HTTP(S)
+// proxy using CONNECT - the standard way to carry a non-HTTP protocol like
+// WebSocket across a plain HTTP proxy.
+func dialViaHTTPConnect(proxyURL *url.URL, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxyURL.Scheme == "https" {
+		conn, err = tls.Dial("tcp", proxyURL.Host, &tls.Config{ServerName: proxyURL.Hostname()})
+	} else {
+		conn, err = net.Dial("tcp", proxyURL.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		connectReq.SetBasicAuth(proxyURL.User.Username(), password)
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("websocket: proxy CONNECT failed: " + resp.Status)
+	}
+	return conn, nil
+}
+
+// rewriteWebSocketHandshakeHeaders points Origin at the upstream's own
+// origin - the same transparency trick the rest of Gopee applies to
+// Referer - so origin checks on the target don't see Gopee's own host.
+// Connection/Upgrade/Sec-WebSocket-* are left as the client sent them since
+// they're required verbatim to complete the protocol upgrade.
+//
+// The client's own Cookie carries Gopee's session cookie, signed for
+// Gopee's cookie name - forwarding it verbatim would hand that session to
+// whatever third-party target the caller asked to upgrade to. It's swapped
+// for the cookies the session's own jar holds for target instead, so a site
+// that gates its WS handshake on a session cookie (chat, live feeds) still
+// sees one, just the right one.
+func rewriteWebSocketHandshakeHeaders(h http.Header, target *url.URL, jar http.CookieJar) {
+	originScheme := "http"
+	if target.Scheme == "wss" {
+		originScheme = "https"
+	}
+	h.Set("Origin", originScheme+"://"+target.Host)
+
+	h.Del("Cookie")
+	if jar == nil {
+		return
+	}
+	// cookiejar only hands out cookies for http/https URLs, so look them up
+	// under the matching scheme
+	cookieURL := *target
+	switch target.Scheme {
+	case "ws":
+		cookieURL.Scheme = "http"
+	case "wss":
+		cookieURL.Scheme = "https"
+	}
+	cookies := jar.Cookies(&cookieURL)
+	if len(cookies) == 0 {
+		return
+	}
+	parts := make([]string, len(cookies))
+	for i, c := range cookies {
+		parts[i] = c.Name + "=" + c.Value
+	}
+	h.Set("Cookie", strings.Join(parts, "; "))
+}
+
+// relayWebSocket copies frames in both directions until one side closes.
+func relayWebSocket(client, upstream net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}